@@ -0,0 +1,197 @@
+package dbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	godbus "github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+
+	"github.com/evilsocket/opensnitch/daemon/log"
+	"github.com/evilsocket/opensnitch/daemon/rule"
+)
+
+const (
+	busName    = "com.opensnitch.Daemon"
+	objectPath = "/com/opensnitch/Daemon"
+	ifaceName  = "com.opensnitch.Daemon"
+)
+
+// Service exposes a subset of the daemon's control surface on the system
+// bus (SetEnabled/IsEnabled, ReloadRules, ListRules/AddRule/DeleteRule),
+// so external tools can drive OpenSnitch without going through the gRPC
+// UI protocol. It also emits a Verdict signal for every connection
+// decision, so log consumers can subscribe instead of scraping stdout.
+type Service struct {
+	conn    *godbus.Conn
+	loader  *rule.Loader
+	reload  func() error
+	enabled int32 // atomic bool, 1 == filtering enabled
+}
+
+// NewService connects to the system bus, exports the daemon object and
+// requests busName. reload is called by ReloadRules() and should re-run
+// rules.Load() against the daemon's configured rules path.
+func NewService(loader *rule.Loader, reload func() error) (*Service, error) {
+	conn, err := godbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("dbus: cannot connect to the system bus: %s", err)
+	}
+
+	s := &Service{
+		conn:    conn,
+		loader:  loader,
+		reload:  reload,
+		enabled: 1,
+	}
+
+	// Whitelist exactly the six control methods via a method table,
+	// rather than exporting *Service by reflection: the latter would
+	// also put every other exported method (Close, Enabled, ...) on the
+	// bus for any local peer to call.
+	methods := map[string]interface{}{
+		"SetEnabled":  s.SetEnabled,
+		"IsEnabled":   s.IsEnabled,
+		"ReloadRules": s.ReloadRules,
+		"ListRules":   s.ListRules,
+		"AddRule":     s.AddRule,
+		"DeleteRule":  s.DeleteRule,
+	}
+	if err := conn.ExportMethodTable(methods, objectPath, ifaceName); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("dbus: cannot export %s: %s", ifaceName, err)
+	}
+
+	if err := conn.Export(introspect.Introspectable(introspectXML), objectPath,
+		"org.freedesktop.DBus.Introspectable"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("dbus: cannot export introspection data: %s", err)
+	}
+
+	reply, err := conn.RequestName(busName, godbus.NameFlagDoNotQueue)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("dbus: cannot request name %s: %s", busName, err)
+	}
+	if reply != godbus.RequestNameReplyPrimaryOwner {
+		conn.Close()
+		return nil, fmt.Errorf("dbus: name %s already taken on the system bus", busName)
+	}
+
+	log.Info("D-Bus control interface listening on %s (%s)", busName, objectPath)
+	return s, nil
+}
+
+// Close releases the bus name and closes the connection.
+func (s *Service) Close() {
+	if s.conn != nil {
+		s.conn.ReleaseName(busName)
+		s.conn.Close()
+	}
+}
+
+// Enabled reports whether filtering is currently active. When disabled,
+// onPacket should ACCEPT every packet unconditionally.
+func (s *Service) Enabled() bool {
+	return atomic.LoadInt32(&s.enabled) == 1
+}
+
+// SetEnabled is exported on the bus as com.opensnitch.Daemon.SetEnabled.
+func (s *Service) SetEnabled(enabled bool) *godbus.Error {
+	if enabled {
+		atomic.StoreInt32(&s.enabled, 1)
+	} else {
+		atomic.StoreInt32(&s.enabled, 0)
+	}
+	log.Important("D-Bus: filtering enabled = %v", enabled)
+	return nil
+}
+
+// IsEnabled is exported on the bus as com.opensnitch.Daemon.IsEnabled.
+func (s *Service) IsEnabled() (bool, *godbus.Error) {
+	return s.Enabled(), nil
+}
+
+// ReloadRules is exported on the bus as com.opensnitch.Daemon.ReloadRules.
+func (s *Service) ReloadRules() *godbus.Error {
+	if err := s.reload(); err != nil {
+		return godbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+// ListRules is exported on the bus as com.opensnitch.Daemon.ListRules. It
+// returns the currently loaded rules JSON-encoded, one object per rule.
+func (s *Service) ListRules() (string, *godbus.Error) {
+	raw, err := json.Marshal(s.loader.Rules())
+	if err != nil {
+		return "", godbus.MakeFailedError(err)
+	}
+	return string(raw), nil
+}
+
+// AddRule is exported on the bus as com.opensnitch.Daemon.AddRule. js is
+// a single rule.Rule encoded as JSON; persist controls whether it's also
+// written to disk.
+func (s *Service) AddRule(js string, persist bool) *godbus.Error {
+	r := rule.Rule{}
+	if err := json.Unmarshal([]byte(js), &r); err != nil {
+		return godbus.MakeFailedError(fmt.Errorf("dbus: invalid rule: %s", err))
+	}
+	if err := s.loader.Add(&r, persist); err != nil {
+		return godbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+// DeleteRule is exported on the bus as com.opensnitch.Daemon.DeleteRule.
+func (s *Service) DeleteRule(name string) *godbus.Error {
+	if err := s.loader.Delete(name); err != nil {
+		return godbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+// EmitVerdict emits the com.opensnitch.Daemon.Verdict signal for a single
+// connection decision, so subscribers don't have to parse stdout logs.
+func (s *Service) EmitVerdict(procPath, dstHost string, dstPort uint16, proto, action, ruleName string) {
+	if s.conn == nil {
+		return
+	}
+	if err := s.conn.Emit(objectPath, ifaceName+".Verdict",
+		procPath, dstHost, dstPort, proto, action, ruleName); err != nil {
+		log.Debug("dbus: error emitting Verdict signal: %s", err)
+	}
+}
+
+const introspectXML = `
+<node>
+	<interface name="com.opensnitch.Daemon">
+		<method name="SetEnabled">
+			<arg direction="in" type="b"/>
+		</method>
+		<method name="IsEnabled">
+			<arg direction="out" type="b"/>
+		</method>
+		<method name="ReloadRules"></method>
+		<method name="ListRules">
+			<arg direction="out" type="s"/>
+		</method>
+		<method name="AddRule">
+			<arg direction="in" type="s"/>
+			<arg direction="in" type="b"/>
+		</method>
+		<method name="DeleteRule">
+			<arg direction="in" type="s"/>
+		</method>
+		<signal name="Verdict">
+			<arg type="s"/>
+			<arg type="s"/>
+			<arg type="q"/>
+			<arg type="s"/>
+			<arg type="s"/>
+			<arg type="s"/>
+		</signal>
+	</interface>
+</node>`
@@ -0,0 +1,118 @@
+// Package eventlog emits one JSON object per connection verdict, so the
+// decisions OpenSnitch makes can be shipped to a SIEM or any other
+// machine that expects structured logs instead of the colored human
+// output in daemon/log.
+package eventlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Entry is a single connection verdict, ready to be JSON-encoded.
+type Entry struct {
+	Timestamp time.Time `json:"ts"`
+	PID       int       `json:"pid"`
+	ProcPath  string    `json:"proc_path"`
+	ProcArgs  []string  `json:"proc_args"`
+	UID       int       `json:"uid"`
+	SrcIP     string    `json:"src_ip"`
+	DstIP     string    `json:"dst_ip"`
+	DstHost   string    `json:"dst_host"`
+	DstPort   uint      `json:"dst_port"`
+	Protocol  string    `json:"proto"`
+	RuleName  string    `json:"rule_name"`
+	Action    string    `json:"action"`
+	Missed    bool      `json:"missed"`
+}
+
+// Logger writes Entry values as one JSON object per line to a
+// size-rotated file, optionally duplicating them to syslog/journald.
+type Logger struct {
+	mu   sync.Mutex
+	out  io.Writer
+	sysw *syslog.Writer
+}
+
+// Config controls where events go and how the on-disk log is rotated.
+type Config struct {
+	// Path is the event log file. Required.
+	Path string
+	// MaxSizeMB rotates the file once it reaches this size, in megabytes.
+	MaxSizeMB int
+	// MaxBackups is how many rotated files to keep around.
+	MaxBackups int
+	// MaxAgeDays removes rotated files older than this, in days. 0 means
+	// files are never removed by age.
+	MaxAgeDays int
+	// Syslog, when true, also writes every entry to the local
+	// syslog/journald daemon under the "opensnitch" tag.
+	Syslog bool
+}
+
+// New opens (or creates) the rotated event log described by cfg.
+func New(cfg Config) (*Logger, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("eventlog: a path is required")
+	}
+
+	l := &Logger{
+		out: &lumberjack.Logger{
+			Filename:   cfg.Path,
+			MaxSize:    cfg.MaxSizeMB,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAgeDays,
+			Compress:   true,
+		},
+	}
+
+	if cfg.Syslog {
+		sysw, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "opensnitch")
+		if err != nil {
+			return nil, fmt.Errorf("eventlog: cannot connect to syslog: %s", err)
+		}
+		l.sysw = sysw
+	}
+
+	return l, nil
+}
+
+// Log JSON-encodes e and appends it to the event log (and syslog, if
+// configured). A malformed entry or failed write is reported only through
+// the error return, not treated as fatal, so a SIEM outage never blocks
+// packet processing.
+func (l *Logger) Log(e Entry) error {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("eventlog: cannot encode entry: %s", err)
+	}
+	raw = append(raw, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.out.Write(raw); err != nil {
+		return fmt.Errorf("eventlog: cannot write entry: %s", err)
+	}
+
+	if l.sysw != nil {
+		l.sysw.Info(string(raw))
+	}
+
+	return nil
+}
+
+// Close releases the syslog connection, if any. The underlying rotated
+// file is closed by the OS on process exit.
+func (l *Logger) Close() error {
+	if l.sysw != nil {
+		return l.sysw.Close()
+	}
+	return nil
+}
@@ -1,18 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
+	"fmt"
+	"hash"
+	"hash/fnv"
 	"io/ioutil"
 	golog "log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/google/gopacket"
 
 	"github.com/evilsocket/opensnitch/daemon/conman"
 	"github.com/evilsocket/opensnitch/daemon/core"
+	"github.com/evilsocket/opensnitch/daemon/dbus"
 	"github.com/evilsocket/opensnitch/daemon/dns"
+	"github.com/evilsocket/opensnitch/daemon/eventlog"
 	"github.com/evilsocket/opensnitch/daemon/firewall"
 	"github.com/evilsocket/opensnitch/daemon/log"
+	"github.com/evilsocket/opensnitch/daemon/metrics"
+	"github.com/evilsocket/opensnitch/daemon/prompter"
 	"github.com/evilsocket/opensnitch/daemon/rule"
 	"github.com/evilsocket/opensnitch/daemon/statistics"
 	"github.com/evilsocket/opensnitch/daemon/ui"
@@ -20,23 +34,49 @@ import (
 	"github.com/evilsocket/go-netfilter-queue"
 )
 
+// pktDrainIdle is how long the shutdown drain waits for pktChan to stay
+// empty before giving up, so packets the kernel handed to the nfqueue a
+// moment ago still get a chance to surface and receive a verdict.
+const pktDrainIdle = 50 * time.Millisecond
+
 var (
-	logFile   = ""
-	rulesPath = "rules"
-	queueNum  = 0
-	workers   = 16
-	debug     = false
+	logFile         = ""
+	rulesPath       = "rules"
+	queueNum        = 0
+	workers         = 16
+	workerQueueSize = 64
+	debug           = false
+	dbusOn          = true
+	drainTimeout    = 5 * time.Second
+
+	eventLogPath       = ""
+	eventLogMaxSizeMB  = 100
+	eventLogMaxBackups = 7
+	eventLogMaxAgeDays = 0
+	eventLogSyslog     = false
+
+	metricsAddr = ""
+
+	promptBackend = "grpc"
+	// See prompter.DefaultDeny for why this has to stay sub-second.
+	promptTimeout = 200 * time.Millisecond
 
 	uiSocket = "unix:///tmp/osui.sock"
 	uiClient = (*ui.Client)(nil)
-
-	err     = (error)(nil)
-	rules   = rule.NewLoader()
-	stats   = statistics.New()
-	queue   = (*netfilter.NFQueue)(nil)
-	pktChan = (<-chan netfilter.NFPacket)(nil)
-	wrkChan = (chan netfilter.NFPacket)(nil)
-	sigChan = (chan os.Signal)(nil)
+	prompt   = (prompter.Prompter)(nil)
+
+	err        = (error)(nil)
+	rules      = rule.NewLoader()
+	rulesMu    = sync.RWMutex{}
+	stats      = statistics.New()
+	dbusSvc    = (*dbus.Service)(nil)
+	evLog      = (*eventlog.Logger)(nil)
+	queue      = (*netfilter.NFQueue)(nil)
+	pktChan    = (<-chan netfilter.NFPacket)(nil)
+	wrkChans   = ([]chan netfilter.NFPacket)(nil)
+	sigChan    = (chan os.Signal)(nil)
+	reloadChan = (chan bool)(nil)
+	wg         = sync.WaitGroup{}
 )
 
 func init() {
@@ -44,61 +84,300 @@ func init() {
 	flag.StringVar(&rulesPath, "rules-path", rulesPath, "Path to load JSON rules from.")
 	flag.IntVar(&queueNum, "queue-num", queueNum, "Netfilter queue number.")
 	flag.IntVar(&workers, "workers", workers, "Number of concurrent workers.")
+	flag.IntVar(&workerQueueSize, "worker-queue-size", workerQueueSize, "How many packets each worker channel can buffer, so opensnitch_worker_queue_depth reflects real backpressure.")
 
 	flag.StringVar(&logFile, "log-file", logFile, "Write logs to this file instead of the standard output.")
 	flag.BoolVar(&debug, "debug", debug, "Enable debug logs.")
+	flag.BoolVar(&dbusOn, "dbus", dbusOn, "Expose a com.opensnitch.Daemon control interface on the system bus.")
+	flag.DurationVar(&drainTimeout, "drain-timeout", drainTimeout, "How long to wait for in-flight packets to be processed on shutdown.")
+
+	flag.StringVar(&eventLogPath, "event-log", eventLogPath, "Write a JSON event per connection verdict to this file, for SIEM ingestion.")
+	flag.IntVar(&eventLogMaxSizeMB, "event-log-max-size", eventLogMaxSizeMB, "Rotate the event log once it reaches this size, in megabytes.")
+	flag.IntVar(&eventLogMaxBackups, "event-log-max-backups", eventLogMaxBackups, "How many rotated event log files to keep.")
+	flag.IntVar(&eventLogMaxAgeDays, "event-log-max-age", eventLogMaxAgeDays, "Remove rotated event log files older than this many days (0: never).")
+	flag.BoolVar(&eventLogSyslog, "event-log-syslog", eventLogSyslog, "Also send event log entries to syslog/journald.")
+
+	flag.StringVar(&metricsAddr, "metrics-addr", metricsAddr, "Serve Prometheus metrics on this address (e.g. :9977). Disabled if empty.")
+
+	flag.StringVar(&promptBackend, "prompter", promptBackend, "How to ask for a verdict when no rule matches: grpc, notify, stdin or default-deny.")
+	flag.DurationVar(&promptTimeout, "prompter-timeout", promptTimeout, "How long the default-deny fallback waits before answering (see prompter.DefaultDeny: this runs on the packet-processing hot path, keep it sub-second).")
+}
+
+// setupPrompter builds the prompter chain: the backend picked on the
+// command line, followed by a default-deny policy so a connection is
+// never silently allowed just because nothing upstream could answer.
+func setupPrompter() prompter.Prompter {
+	chain := prompter.Chain{}
+
+	switch promptBackend {
+	case "grpc":
+		chain = append(chain, prompter.NewGRPC(uiClient))
+
+	case "notify":
+		n, err := prompter.NewNotify()
+		if err != nil {
+			log.Warning("Could not start the notification prompter: %s", err)
+		} else {
+			chain = append(chain, n)
+		}
+
+	case "stdin":
+		chain = append(chain, prompter.NewStdin(os.Stdin, os.Stdout))
+
+	case "default-deny":
+		// nothing to add, the fallback below already covers it
+
+	default:
+		log.Warning("Unknown -prompter %q, falling back to default-deny.", promptBackend)
+	}
+
+	chain = append(chain, prompter.NewDefaultDeny(promptTimeout))
+	return chain
 }
 
-func setupSignals() {
+// reloadRules re-reads rulesPath from disk, guarding against workers that
+// are concurrently matching in-flight packets against the current rule
+// set.
+func reloadRules() error {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	return rules.Load(rulesPath)
+}
+
+func setupSignals(cancel context.CancelFunc) {
 	sigChan = make(chan os.Signal, 1)
+	reloadChan = make(chan bool, 1)
 	signal.Notify(sigChan,
 		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 	go func() {
-		sig := <-sigChan
-		log.Raw("\n")
-		log.Important("Got signal: %v", sig)
-		doCleanup()
-		os.Exit(0)
+		for sig := range sigChan {
+			if sig == syscall.SIGHUP {
+				log.Important("Got SIGHUP, reloading rules ...")
+				reloadChan <- true
+				continue
+			}
+
+			log.Raw("\n")
+			log.Important("Got signal: %v", sig)
+			cancel()
+			return
+		}
 	}()
 }
 
-func worker(id int) {
-	log.Debug("Worker #%d started.", id)
-	for true {
-		select {
-		case pkt := <-wrkChan:
-			onPacket(pkt)
+// watchRules watches rulesPath for added, modified or removed JSON rule
+// files and triggers the same reload path as a SIGHUP, so a `cp` into the
+// rules directory is picked up without having to signal the daemon.
+func watchRules() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Warning("Could not start the rules watcher: %s", err)
+		return
+	}
+
+	if err := watcher.Add(rulesPath); err != nil {
+		log.Warning("Could not watch %s for changes: %s", rulesPath, err)
+		return
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				log.Debug("Rules path changed (%s), reloading ...", event)
+				reloadChan <- true
+
+			case werr, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Warning("Rules watcher error: %s", werr)
+			}
 		}
+	}()
+}
+
+// worker processes packets from its own channel ch until it's closed, at which point
+// any packet still in flight has already been handed to onPacket and its
+// verdict set, so the caller only needs to wait on wg to know every
+// worker is done.
+func worker(id int, ch <-chan netfilter.NFPacket) {
+	defer wg.Done()
+	workerLabel := fmt.Sprintf("%d", id)
+	log.Debug("Worker #%d started.", id)
+	for pkt := range ch {
+		onPacket(pkt)
+		metrics.PacketsProcessedTotal.WithLabelValues(workerLabel).Inc()
 	}
+	log.Debug("Worker #%d stopped.", id)
 }
 
 func setupWorkers() {
 	log.Debug("Starting %d workers ...", workers)
-	// setup the workers
-	wrkChan = make(chan netfilter.NFPacket)
+	// setup one channel per worker, so packets belonging to the same
+	// connection are always handed to the same goroutine and processed
+	// in order.
+	wrkChans = make([]chan netfilter.NFPacket, workers)
 	for i := 0; i < workers; i++ {
-		go worker(i)
+		wrkChans[i] = make(chan netfilter.NFPacket, workerQueueSize)
+		wg.Add(1)
+		go worker(i, wrkChans[i])
 	}
 }
 
+// hashPacket derives a stable shard key from a packet's 5-tuple (network
+// and transport flow), so every packet of a connection lands on the same
+// worker channel regardless of which goroutine happens to be free, and
+// regardless of which direction a given packet happens to travel in
+// (e.g. an outbound DNS query vs. its inbound response).
+func hashPacket(pkt netfilter.NFPacket) uint32 {
+	h := fnv.New32a()
+
+	if nl := pkt.Packet.NetworkLayer(); nl != nil {
+		writeFlowSorted(h, nl.NetworkFlow())
+	}
+	if tl := pkt.Packet.TransportLayer(); tl != nil {
+		h.Write([]byte(tl.LayerType().String()))
+		writeFlowSorted(h, tl.TransportFlow())
+	}
+
+	return h.Sum32()
+}
+
+// writeFlowSorted writes a flow's two endpoints to h in a fixed,
+// content-sorted order, so a flow and its reverse (same connection, seen
+// from either side) hash identically instead of landing on different
+// worker shards.
+func writeFlowSorted(h hash.Hash32, flow gopacket.Flow) {
+	a, b := flow.Src().Raw(), flow.Dst().Raw()
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	h.Write(a)
+	h.Write(b)
+}
+
+// totalQueueDepth sums how many packets are currently buffered across all
+// worker shards, so opensnitch_worker_queue_depth reflects the daemon's
+// actual backlog instead of just whichever single shard the last
+// dispatched packet happened to hash into.
+func totalQueueDepth() int {
+	total := 0
+	for _, ch := range wrkChans {
+		total += len(ch)
+	}
+	return total
+}
+
 func doCleanup() {
 	log.Info("Cleaning up ...")
 	firewall.QueueDNSResponses(false, queueNum)
 	firewall.QueueConnections(false, queueNum)
 	firewall.RejectMarked(false)
+	if dbusSvc != nil {
+		dbusSvc.Close()
+	}
+	if evLog != nil {
+		evLog.Close()
+	}
+}
+
+// shutdown tears down the firewall rules first so no new packet can be
+// queued, then closes every worker channel in wrkChans and gives the workers up to drainTimeout to
+// finish processing whatever they already picked up. Once that grace
+// period is over, or the workers are done, any packet still sitting in
+// pktChan is ACCEPTed so the kernel doesn't hold connections open waiting
+// for a verdict that will never come.
+func shutdown() {
+	doCleanup()
+
+	for _, ch := range wrkChans {
+		close(ch)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Debug("All workers drained.")
+	case <-time.After(drainTimeout):
+		log.Warning("Timed out waiting for workers to drain.")
+	}
+
+	// Packets the kernel already handed to the nfqueue can still be a
+	// few microseconds away from landing in pktChan, so give the drain
+	// an idle window instead of quitting the instant the channel is
+	// momentarily empty: that would race the exact hang this request
+	// was written to fix.
+	for {
+		select {
+		case pkt := <-pktChan:
+			pkt.SetVerdict(netfilter.NF_ACCEPT)
+		case <-time.After(pktDrainIdle):
+			os.Exit(0)
+		}
+	}
+}
+
+// logEvent writes a structured event for a connection verdict, if
+// --event-log is enabled. It's a thin wrapper so onPacket doesn't have to
+// care whether evLog is configured.
+func logEvent(con *conman.Connection, r *rule.Rule, missed bool, action string) {
+	if evLog == nil {
+		return
+	}
+
+	if err := evLog.Log(eventlog.Entry{
+		Timestamp: time.Now(),
+		PID:       con.Process.Pid,
+		ProcPath:  con.Process.Path,
+		ProcArgs:  con.Process.Args,
+		UID:       con.Process.UID,
+		SrcIP:     con.SrcIP.String(),
+		DstIP:     con.DstIP.String(),
+		DstHost:   con.To(),
+		DstPort:   uint(con.DstPort),
+		Protocol:  con.Protocol,
+		RuleName:  r.Name,
+		Action:    action,
+		Missed:    missed,
+	}); err != nil {
+		log.Warning("Error writing event log entry: %s", err)
+	}
 }
 
 func onPacket(packet netfilter.NFPacket) {
-	// DNS response, just parse, track and accept.
+	start := time.Now()
+	defer func() { metrics.PacketLatency.Observe(time.Since(start).Seconds()) }()
+
+	// DNS response, just parse, track and accept. This runs regardless
+	// of the D-Bus Enabled() bypass below: DNS tracking and connection
+	// filtering are orthogonal, and skipping it while disabled would
+	// leave hostname-based rules resolving against a stale cache once
+	// filtering is switched back on.
 	if dns.TrackAnswers(packet.Packet) == true {
 		packet.SetVerdict(netfilter.NF_ACCEPT)
 		stats.OnDNSResponse()
 		return
 	}
 
+	// filtering can be switched off at runtime via the D-Bus
+	// SetEnabled() method, bypassing every rule check below.
+	if dbusSvc != nil && !dbusSvc.Enabled() {
+		packet.SetVerdict(netfilter.NF_ACCEPT)
+		return
+	}
+
 	// Parse the connection state
 	con := conman.Parse(packet)
 	if con == nil {
@@ -110,12 +389,15 @@ func onPacket(packet netfilter.NFPacket) {
 	// search a match in preloaded rules
 	connected := false
 	missed := false
+	rulesMu.RLock()
 	r := rules.FindFirstMatch(con)
+	rulesMu.RUnlock()
 	if r == nil {
 		missed = true
-		// no rule matched, send a request to the
-		// UI client if connected and running
-		r, connected = uiClient.Ask(con)
+		// no rule matched, ask the configured prompter chain
+		// (gRPC UI, desktop notification, TTY, ... ending in a
+		// default-deny policy that always answers)
+		r, connected = prompt.Ask(con)
 		if connected {
 			ok := false
 			pers := ""
@@ -127,6 +409,7 @@ func onPacket(packet netfilter.NFPacket) {
 			}
 
 			// check if and how the rule needs to be saved
+			rulesMu.Lock()
 			if r.Duration == rule.Restart {
 				pers = "Added"
 				// add to the rules but do not save to disk
@@ -144,6 +427,7 @@ func onPacket(packet netfilter.NFPacket) {
 					ok = true
 				}
 			}
+			rulesMu.Unlock()
 
 			if ok {
 				log.Important("%s new rule: %s if %s", pers, action, r.Operator.String())
@@ -161,12 +445,22 @@ func onPacket(packet netfilter.NFPacket) {
 			ruleName = log.Dim(r.Name)
 		}
 		log.Debug("%s %s -> %s:%d (%s)", log.Bold(log.Green("✔")), log.Bold(con.Process.Path), log.Bold(con.To()), con.DstPort, ruleName)
+		if dbusSvc != nil {
+			dbusSvc.EmitVerdict(con.Process.Path, con.To(), uint16(con.DstPort), con.Protocol, string(rule.Allow), r.Name)
+		}
+		logEvent(con, r, missed, string(rule.Allow))
+		metrics.VerdictsTotal.WithLabelValues(string(rule.Allow), r.Name).Inc()
 		return
 	}
 
 	packet.SetVerdict(netfilter.NF_DROP)
 
 	log.Warning("%s %s -> %s:%d (%s)", log.Bold(log.Red("✘")), log.Bold(con.Process.Path), log.Bold(con.To()), con.DstPort, log.Red(r.Name))
+	if dbusSvc != nil {
+		dbusSvc.EmitVerdict(con.Process.Path, con.To(), uint16(con.DstPort), con.Protocol, string(rule.Deny), r.Name)
+	}
+	logEvent(con, r, missed, string(rule.Deny))
+	metrics.VerdictsTotal.WithLabelValues(string(rule.Deny), r.Name).Inc()
 }
 
 func main() {
@@ -187,18 +481,44 @@ func main() {
 
 	log.Important("Starting %s v%s", core.Name, core.Version)
 
-	rulesPath, err := core.ExpandPath(rulesPath)
+	rulesPath, err = core.ExpandPath(rulesPath)
 	if err != nil {
 		log.Fatal("%s", err)
 	}
 
-	setupSignals()
+	ctx, cancel := context.WithCancel(context.Background())
+	setupSignals(cancel)
 
 	log.Info("Loading rules from %s ...", rulesPath)
-	if err := rules.Load(rulesPath); err != nil {
+	if err := reloadRules(); err != nil {
 		log.Fatal("%s", err)
 	}
+	watchRules()
+
 	uiClient = ui.NewClient(uiSocket, stats)
+	prompt = setupPrompter()
+
+	if dbusOn {
+		if dbusSvc, err = dbus.NewService(rules, reloadRules); err != nil {
+			log.Warning("Could not start the D-Bus control interface: %s", err)
+		}
+	}
+
+	if metricsAddr != "" {
+		go metrics.Serve(metricsAddr)
+	}
+
+	if eventLogPath != "" {
+		if evLog, err = eventlog.New(eventlog.Config{
+			Path:       eventLogPath,
+			MaxSizeMB:  eventLogMaxSizeMB,
+			MaxBackups: eventLogMaxBackups,
+			MaxAgeDays: eventLogMaxAgeDays,
+			Syslog:     eventLogSyslog,
+		}); err != nil {
+			log.Warning("Could not start the event log: %s", err)
+		}
+	}
 
 	// prepare the queue
 	setupWorkers()
@@ -218,10 +538,21 @@ func main() {
 	}
 
 	log.Info("Running on netfilter queue #%d ...", queueNum)
-	for true {
+	for {
 		select {
 		case pkt := <-pktChan:
-			wrkChan <- pkt
+			idx := hashPacket(pkt) % uint32(workers)
+			metrics.WorkerQueueDepth.Set(float64(totalQueueDepth()))
+			wrkChans[idx] <- pkt
+
+		case <-reloadChan:
+			log.Info("Reloading rules from %s ...", rulesPath)
+			if err := reloadRules(); err != nil {
+				log.Error("Error while reloading rules: %s", err)
+			}
+
+		case <-ctx.Done():
+			shutdown()
 		}
 	}
 }
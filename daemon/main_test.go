@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/evilsocket/go-netfilter-queue"
+)
+
+// buildTestPacket serializes a single TCP segment so hashPacket has real
+// network/transport layers to read from, roughly what an iperf flow looks
+// like on the wire.
+func buildTestPacket(srcIP, dstIP net.IP, srcPort, dstPort uint16) netfilter.NFPacket {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		SrcIP:    srcIP,
+		DstIP:    dstIP,
+		Protocol: layers.IPProtocolTCP,
+	}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload([]byte("iperf"))); err != nil {
+		panic(err)
+	}
+
+	pkt := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	return netfilter.NFPacket{Packet: pkt}
+}
+
+var (
+	testClientIP = net.IPv4(10, 0, 0, 1)
+	testServerIP = net.IPv4(10, 0, 0, 2)
+)
+
+// TestHashPacketDirectionAgnostic ensures the same connection hashes to
+// the same shard no matter which direction a given packet travels in,
+// e.g. an outbound query and its inbound response.
+func TestHashPacketDirectionAgnostic(t *testing.T) {
+	outbound := buildTestPacket(testClientIP, testServerIP, 51234, 53)
+	inbound := buildTestPacket(testServerIP, testClientIP, 53, 51234)
+
+	if hashPacket(outbound) != hashPacket(inbound) {
+		t.Fatalf("packets from the same connection hashed to different shards depending on direction")
+	}
+}
+
+// BenchmarkHashPacketSingleFlow models an iperf-style burst from one
+// connection: every packet shares the same 5-tuple and must land on the
+// same worker shard.
+func BenchmarkHashPacketSingleFlow(b *testing.B) {
+	pkt := buildTestPacket(testClientIP, testServerIP, 51234, 5201)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hashPacket(pkt)
+	}
+}
+
+// BenchmarkDispatchThroughput measures how fast packets from many
+// concurrent flows can be sharded and handed off to worker channels,
+// simulating several parallel iperf streams.
+func BenchmarkDispatchThroughput(b *testing.B) {
+	const numWorkers = 16
+	chans := make([]chan netfilter.NFPacket, numWorkers)
+	for i := range chans {
+		chans[i] = make(chan netfilter.NFPacket, 64)
+		go func(ch chan netfilter.NFPacket) {
+			for range ch {
+			}
+		}(chans[i])
+	}
+
+	pkts := make([]netfilter.NFPacket, 32)
+	for i := range pkts {
+		pkts[i] = buildTestPacket(testClientIP, testServerIP, uint16(40000+i), 5201)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pkt := pkts[i%len(pkts)]
+		idx := hashPacket(pkt) % numWorkers
+		chans[idx] <- pkt
+	}
+	b.StopTimer()
+
+	for _, ch := range chans {
+		close(ch)
+	}
+	time.Sleep(time.Millisecond)
+}
@@ -0,0 +1,59 @@
+// Package metrics exposes the daemon's internal counters (verdicts,
+// packets processed, queue depth) as Prometheus metrics, so a fleet of
+// OpenSnitch daemons can be observed without the UI running.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/evilsocket/opensnitch/daemon/log"
+)
+
+var (
+	// VerdictsTotal counts every connection decision, labeled by the
+	// action taken (allow/deny) and the rule that produced it.
+	VerdictsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "opensnitch_verdicts_total",
+		Help: "Total number of connection verdicts, by action and rule.",
+	}, []string{"action", "rule"})
+
+	// PacketsProcessedTotal counts packets handled by each worker
+	// goroutine.
+	PacketsProcessedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "opensnitch_packets_processed_total",
+		Help: "Total number of packets processed, by worker.",
+	}, []string{"worker"})
+
+	// PacketLatency tracks how long onPacket takes to reach a verdict.
+	PacketLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "opensnitch_packet_latency_seconds",
+		Help:    "Time spent processing a single packet, in seconds.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// WorkerQueueDepth reports how many packets are buffered in total
+	// across all per-worker channels, waiting for their worker.
+	WorkerQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "opensnitch_worker_queue_depth",
+		Help: "Number of packets currently queued for a worker.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(VerdictsTotal, PacketsProcessedTotal, PacketLatency, WorkerQueueDepth)
+}
+
+// Serve starts an HTTP server exposing /metrics on addr. It blocks, so
+// callers should run it in its own goroutine.
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Info("Serving Prometheus metrics on %s/metrics ...", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Error("Metrics server stopped: %s", err)
+	}
+}
@@ -0,0 +1,23 @@
+package prompter
+
+import (
+	"github.com/evilsocket/opensnitch/daemon/conman"
+	"github.com/evilsocket/opensnitch/daemon/rule"
+	"github.com/evilsocket/opensnitch/daemon/ui"
+)
+
+// GRPC asks the existing gRPC UI client, preserving today's behaviour for
+// anyone already running the Python/Qt UI.
+type GRPC struct {
+	client *ui.Client
+}
+
+// NewGRPC wraps an already-connected ui.Client as a Prompter.
+func NewGRPC(client *ui.Client) *GRPC {
+	return &GRPC{client: client}
+}
+
+// Ask delegates to the underlying ui.Client.
+func (g *GRPC) Ask(con *conman.Connection) (*rule.Rule, bool) {
+	return g.client.Ask(con)
+}
@@ -0,0 +1,144 @@
+package prompter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	godbus "github.com/godbus/dbus/v5"
+
+	"github.com/evilsocket/opensnitch/daemon/conman"
+	"github.com/evilsocket/opensnitch/daemon/log"
+	"github.com/evilsocket/opensnitch/daemon/rule"
+)
+
+const notifyTimeout = 30 * time.Second
+
+// Notify asks via a desktop notification (org.freedesktop.Notifications)
+// with Allow/Deny/Always Allow/Always Deny actions, for setups where
+// opensnitch-ui isn't running but a notification daemon is.
+type Notify struct {
+	conn *godbus.Conn
+
+	mu      sync.Mutex
+	pending map[uint32]chan string // notification id -> its Ask() call
+}
+
+// NewNotify connects to the session bus (not the system bus: that's
+// where a user's notification daemon lives), subscribes to
+// ActionInvoked signals once, and starts a dispatcher that demuxes them
+// by notification id to whichever concurrent Ask() call is waiting on
+// each one.
+func NewNotify() (*Notify, error) {
+	conn, err := godbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("prompter/notify: cannot connect to the session bus: %s", err)
+	}
+
+	if err := conn.AddMatchSignal(
+		godbus.WithMatchInterface("org.freedesktop.Notifications"),
+		godbus.WithMatchMember("ActionInvoked"),
+	); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("prompter/notify: cannot subscribe to ActionInvoked: %s", err)
+	}
+
+	n := &Notify{conn: conn, pending: map[uint32]chan string{}}
+
+	raw := make(chan *godbus.Signal, 8)
+	conn.Signal(raw)
+	go n.dispatch(raw)
+
+	return n, nil
+}
+
+// dispatch routes each ActionInvoked signal to the Ask() call waiting on
+// its notification id, if any. Workers run 16-wide by default and this
+// daemon shards packets across all of them, so several Ask() calls are
+// routinely in flight at once; a single shared channel would let one
+// call's signal be stolen by another's receive, so each pending call
+// gets its own channel instead.
+func (n *Notify) dispatch(raw <-chan *godbus.Signal) {
+	for sig := range raw {
+		id, action, ok := parseActionInvoked(sig)
+		if !ok {
+			continue
+		}
+
+		n.mu.Lock()
+		ch, found := n.pending[id]
+		delete(n.pending, id)
+		n.mu.Unlock()
+
+		if found {
+			ch <- action
+		}
+	}
+}
+
+// Ask pops a notification titled after the process and waits up to
+// notifyTimeout for the matching ActionInvoked signal. connected is
+// false on timeout or bus error, so the Chain falls through to the next
+// prompter instead of blocking the packet forever.
+func (n *Notify) Ask(con *conman.Connection) (*rule.Rule, bool) {
+	obj := n.conn.Object("org.freedesktop.Notifications", godbus.ObjectPath("/org/freedesktop/Notifications"))
+
+	call := obj.Call("org.freedesktop.Notifications.Notify", 0,
+		"OpenSnitch",
+		uint32(0),
+		"",
+		con.Process.Path,
+		fmt.Sprintf("wants to connect to %s:%d", con.To(), con.DstPort),
+		[]string{"allow", "Allow", "deny", "Deny", "always-allow", "Always Allow", "always-deny", "Always Deny"},
+		map[string]godbus.Variant{},
+		int32(notifyTimeout/time.Millisecond),
+	)
+	if call.Err != nil {
+		log.Warning("prompter/notify: error showing notification: %s", call.Err)
+		return nil, false
+	}
+
+	var id uint32
+	if err := call.Store(&id); err != nil {
+		log.Warning("prompter/notify: error reading notification id: %s", err)
+		return nil, false
+	}
+
+	ch := make(chan string, 1)
+	n.mu.Lock()
+	n.pending[id] = ch
+	n.mu.Unlock()
+
+	select {
+	case action := <-ch:
+		return actionToRule(action), true
+
+	case <-time.After(notifyTimeout):
+		n.mu.Lock()
+		delete(n.pending, id)
+		n.mu.Unlock()
+		return nil, false
+	}
+}
+
+func parseActionInvoked(sig *godbus.Signal) (id uint32, action string, ok bool) {
+	if sig.Name != "org.freedesktop.Notifications.ActionInvoked" || len(sig.Body) != 2 {
+		return 0, "", false
+	}
+	id, idOK := sig.Body[0].(uint32)
+	action, actionOK := sig.Body[1].(string)
+	return id, action, idOK && actionOK
+}
+
+func actionToRule(action string) *rule.Rule {
+	switch action {
+	case "allow":
+		return &rule.Rule{Name: "notify/allow", Action: rule.Allow}
+	case "always-allow":
+		return &rule.Rule{Name: "notify/allow", Action: rule.Allow, Duration: rule.Always}
+	case "always-deny":
+		return &rule.Rule{Name: "notify/deny", Action: rule.Deny, Duration: rule.Always}
+	default:
+		return &rule.Rule{Name: "notify/deny", Action: rule.Deny}
+	}
+}
@@ -0,0 +1,38 @@
+package prompter
+
+import (
+	"time"
+
+	"github.com/evilsocket/opensnitch/daemon/conman"
+	"github.com/evilsocket/opensnitch/daemon/log"
+	"github.com/evilsocket/opensnitch/daemon/rule"
+)
+
+// DefaultDeny is the last resort in a Chain: it never fails to answer,
+// so a connection is never silently allowed for lack of a UI. It waits
+// timeout before answering; the prompters ahead of it in the Chain have
+// already answered by then and are not asked again. Ask runs on the
+// worker goroutine handling this packet, so timeout is a direct
+// per-packet stall on the hot path, not a background wait: keep it
+// sub-second, or every unmatched connection on a box with no UI
+// connected blocks its worker (and, with per-5-tuple worker pinning,
+// every other flow sharing its shard) for the full duration.
+type DefaultDeny struct {
+	timeout time.Duration
+}
+
+// NewDefaultDeny builds a DefaultDeny that waits timeout before denying.
+// A timeout of 0 answers immediately.
+func NewDefaultDeny(timeout time.Duration) *DefaultDeny {
+	return &DefaultDeny{timeout: timeout}
+}
+
+// Ask blocks the calling goroutine for the full d.timeout and always
+// returns connected == true, so it must be the last entry in a Chain.
+func (d *DefaultDeny) Ask(con *conman.Connection) (*rule.Rule, bool) {
+	if d.timeout > 0 {
+		time.Sleep(d.timeout)
+	}
+	log.Warning("No prompter answered for %s -> %s:%d, denying by default policy.", con.Process.Path, con.To(), con.DstPort)
+	return &rule.Rule{Name: "default-deny", Action: rule.Deny}, true
+}
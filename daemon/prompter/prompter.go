@@ -0,0 +1,37 @@
+// Package prompter decides who answers "what should happen to this
+// connection?" when no rule matches. The gRPC UI used to be the only
+// answer path; on a headless server with no UI connected that meant
+// falling through to a zero-value rule.Rule, which silently allows
+// traffic. A Prompter gives administrators a real answer path instead.
+package prompter
+
+import (
+	"github.com/evilsocket/opensnitch/daemon/conman"
+	"github.com/evilsocket/opensnitch/daemon/rule"
+)
+
+// Prompter asks something (the GUI, a desktop notification, a TTY, a
+// fixed policy) what to do about a connection with no matching rule. The
+// second return value reports whether the prompter was actually able to
+// produce an answer; false means the caller should fall through to the
+// next prompter in a Chain.
+type Prompter interface {
+	Ask(con *conman.Connection) (r *rule.Rule, connected bool)
+}
+
+// Chain tries each Prompter in order and returns the first answer with
+// connected == true. It's how a headless deployment can prefer the gRPC
+// UI when it's running, fall back to a desktop notification, and finally
+// fall back to a default-deny policy so a connection is never silently
+// allowed for lack of an answer.
+type Chain []Prompter
+
+// Ask walks the chain in order, returning the first connected answer.
+func (c Chain) Ask(con *conman.Connection) (*rule.Rule, bool) {
+	for _, p := range c {
+		if r, connected := p.Ask(con); connected {
+			return r, connected
+		}
+	}
+	return nil, false
+}
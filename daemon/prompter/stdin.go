@@ -0,0 +1,50 @@
+package prompter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/evilsocket/opensnitch/daemon/conman"
+	"github.com/evilsocket/opensnitch/daemon/log"
+	"github.com/evilsocket/opensnitch/daemon/rule"
+)
+
+// Stdin asks on a TTY, for headless servers where there's an operator at
+// the console but no desktop environment to put up a notification.
+type Stdin struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// NewStdin builds a Stdin prompter reading from in and writing prompts to
+// out (typically os.Stdin / os.Stdout).
+func NewStdin(in io.Reader, out io.Writer) *Stdin {
+	return &Stdin{in: bufio.NewReader(in), out: out}
+}
+
+// Ask prints the connection details and blocks for a one-line answer:
+// "a" allow once, "A" allow always, "d" deny once, "D" deny always.
+// Anything else is treated as deny-once, so a bare enter on an
+// unattended console doesn't silently allow traffic.
+func (s *Stdin) Ask(con *conman.Connection) (*rule.Rule, bool) {
+	fmt.Fprintf(s.out, "\n%s (%s) -> %s:%d [a/A/d/D]? ", con.Process.Path, con.Process.Args, con.To(), con.DstPort)
+
+	line, err := s.in.ReadString('\n')
+	if err != nil {
+		log.Warning("prompter/stdin: error reading answer: %s", err)
+		return &rule.Rule{Name: "stdin/deny", Action: rule.Deny}, true
+	}
+
+	switch strings.TrimSpace(line) {
+	case "a":
+		return &rule.Rule{Name: "stdin/allow", Action: rule.Allow}, true
+	case "A":
+		return &rule.Rule{Name: "stdin/allow", Action: rule.Allow, Duration: rule.Always}, true
+	case "D":
+		return &rule.Rule{Name: "stdin/deny", Action: rule.Deny, Duration: rule.Always}, true
+	default:
+		return &rule.Rule{Name: "stdin/deny", Action: rule.Deny}, true
+	}
+}